@@ -15,6 +15,9 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -22,7 +25,10 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -33,29 +39,89 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
 )
 
+var shutdownEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "statsd_exporter_shutdown_events_dropped_total",
+	Help: "Number of events dropped while draining the event queue during shutdown.",
+})
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("statsd_exporter"))
+	prometheus.MustRegister(shutdownEventsDropped)
 }
 
-func startListeningOn(listenAddress string) error {
+func listenerFor(listenAddress string) (net.Listener, error) {
 	if !strings.HasPrefix(listenAddress, "unix") {
-		return http.ListenAndServe(listenAddress, nil)
+		return net.Listen("tcp", listenAddress)
 	}
 	path := strings.Split(listenAddress, ":")[1]
 	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = os.Chmod(path, 0777)
-	if err != nil {
+	if err := os.Chmod(path, 0777); err != nil {
 		log.Warn(err)
 	}
-	return http.Serve(listener, nil)
+	return listener, nil
+}
+
+// webConfigFile holds the parsed --web.config.file, re-read whenever reload is
+// called (on SIGHUP or POST /-/reload), and serves up-to-date TLS config to
+// http.Server via GetCertificate and GetConfigForClient, so certificates can
+// be rotated by sending SIGHUP without restarting the exporter.
+type webConfigFile struct {
+	path    string
+	current atomic.Value // *webConfig
+}
+
+func newWebConfigFile(path string) (*webConfigFile, error) {
+	w := &webConfigFile{path: path}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *webConfigFile) reload() error {
+	cfg, err := loadWebConfig(w.path)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.tlsConfig(); err != nil {
+		return err
+	}
+	w.current.Store(cfg)
+	return nil
+}
+
+func (w *webConfigFile) get() *webConfig {
+	return w.current.Load().(*webConfig)
 }
 
-func serveHTTP(listenAddress, metricsEndpoint string) {
-	http.Handle(metricsEndpoint, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// basicAuthMiddleware wraps next with HTTP basic-auth, re-reading the
+// current webConfig on every request so a SIGHUP/`/-/reload`-triggered
+// change to basic_auth_users takes effect immediately, without rebuilding
+// the handler or restarting the exporter.
+func (w *webConfigFile) basicAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.get().basicAuthMiddleware(next).ServeHTTP(rw, r)
+	})
+}
+
+// serveHTTP runs the metrics web server until ctx is cancelled, then shuts it
+// down gracefully (bounded by shutdownTimeout) and signals doneCh once the
+// shutdown has completed. If configured via --web.config.file, TLS settings
+// are re-read from webCfg on every TLS handshake and basic-auth on every
+// request, so a SIGHUP-triggered reload takes effect without re-binding the
+// listener. Whether the server speaks TLS or plaintext HTTP at all is decided
+// once, from the config loaded at startup.
+func serveHTTP(ctx context.Context, listenAddress, metricsEndpoint string, webCfg *webConfigFile, reload *reloader, ready *readiness, shutdownTimeout time.Duration, doneCh chan<- struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle(metricsEndpoint, webCfg.basicAuthMiddleware(promhttp.Handler()))
+	mux.Handle("/-/reload", webCfg.basicAuthMiddleware(reload))
+	mux.HandleFunc("/-/healthy", ready.healthyHandler)
+	mux.HandleFunc("/-/ready", ready.readyHandler)
+	mux.Handle("/debug/mappings", webCfg.basicAuthMiddleware(http.HandlerFunc(reload.debugMappings)))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte(`<html>
 			<head><title>StatsD Exporter</title></head>
 			<body>
@@ -64,10 +130,62 @@ func serveHTTP(listenAddress, metricsEndpoint string) {
 			</body>
 			</html>`))
 		if err != nil {
-			log.Fatal(err)
+			log.Error(err)
 		}
 	})
-	log.Fatal(startListeningOn(listenAddress))
+
+	listener, err := listenerFor(listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{
+		Addr:    listenAddress,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			// GetCertificate makes http.Server.ServeTLS see a configured cert
+			// and skip trying to load one from the (empty) cert/key file
+			// arguments passed to ServeTLS below.
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cfg, err := webCfg.get().tlsConfig()
+				if err != nil {
+					return nil, err
+				}
+				if cfg == nil || len(cfg.Certificates) == 0 {
+					return nil, fmt.Errorf("no certificate configured in --web.config.file")
+				}
+				return &cfg.Certificates[0], nil
+			},
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return webCfg.get().tlsConfig()
+			},
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Infoln("Shutting down HTTP server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorln("Error shutting down HTTP server:", err)
+		}
+		close(doneCh)
+	}()
+
+	tlsCfg, err := webCfg.get().tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if tlsCfg == nil {
+		err = server.Serve(listener)
+	} else {
+		err = server.ServeTLS(listener, "", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 func ipPortFromString(addr string) (*net.IPAddr, int) {
@@ -110,28 +228,6 @@ func tcpAddrFromString(addr string) *net.TCPAddr {
 	}
 }
 
-func configReloader(fileName string, mapper *mapper.MetricMapper, cacheSize int) {
-
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGHUP)
-
-	for s := range signals {
-		if fileName == "" {
-			log.Warnf("Received %s but no mapping config to reload", s)
-			continue
-		}
-		log.Infof("Received %s, attempting reload", s)
-		err := mapper.InitFromFile(fileName, cacheSize)
-		if err != nil {
-			log.Errorln("Error reloading config:", err)
-			configLoads.WithLabelValues("failure").Inc()
-		} else {
-			log.Infoln("Config reloaded successfully")
-			configLoads.WithLabelValues("success").Inc()
-		}
-	}
-}
-
 func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string) error {
 	f, err := os.Create(dumpFilename)
 	if err != nil {
@@ -162,6 +258,10 @@ func main() {
 		eventFlushThreshold  = kingpin.Flag("statsd.event-flush-threshold", "Number of events to hold in queue before flushing").Default("1000").Int()
 		eventFlushInterval   = kingpin.Flag("statsd.event-flush-interval", "Number of events to hold in queue before flushing").Default("200ms").Duration()
 		dumpFSMPath          = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
+		shutdownTimeoutFlag  = kingpin.Flag("shutdown-timeout", "Maximum time to wait on shutdown for the event queue to drain, and for the HTTP server to shut down.").Default("1m").Duration()
+		webConfigFilePath    = kingpin.Flag("web.config.file", "Path to a file with TLS and basic-auth configuration for the /metrics endpoint. \"\" disables TLS and auth.").Default("").String()
+		relayAddresses       = kingpin.Flag("statsd.relay-addresses", "Comma-separated list of udp://host:port or tcp://host:port addresses to forward received statsd lines to, in addition to exporting them as Prometheus metrics.").Default("").String()
+		relayPacketSize      = kingpin.Flag("statsd.relay-packet-size", "Maximum size (in bytes) of a batched packet forwarded to a relay destination.").Default("1432").Int()
 	)
 
 	log.AddFlags(kingpin.CommandLine)
@@ -178,11 +278,34 @@ func main() {
 	log.Infof("Accepting StatsD Traffic: UDP %v, TCP %v, Unixgram %v", *statsdListenUDP, *statsdListenTCP, *statsdListenUnixgram)
 	log.Infoln("Accepting Prometheus Requests on", *listenAddress)
 
-	go serveHTTP(*listenAddress, *metricsEndpoint)
+	webCfg, err := newWebConfigFile(*webConfigFilePath)
+	if err != nil {
+		log.Fatal("Error loading web config file:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ready := &readiness{}
+	mapper := &mapper.MetricMapper{MappingsCount: mappingsCount}
+	reload := newReloader(*mappingConfig, mapper, *cacheSize, webCfg)
+
+	httpDone := make(chan struct{})
+	go serveHTTP(ctx, *listenAddress, *metricsEndpoint, webCfg, reload, ready, *shutdownTimeoutFlag, httpDone)
+
+	var relay *Relay
+	if *relayAddresses != "" {
+		relay, err = NewRelay(ctx, strings.Split(*relayAddresses, ","), *relayPacketSize)
+		if err != nil {
+			log.Fatal("Error starting relay:", err)
+		}
+	}
 
 	events := make(chan Events, *eventQueueSize)
-	defer close(events)
-	eventQueue := newEventQueue(events, *eventFlushThreshold, *eventFlushInterval)
+	eventQueue := newEventQueue(events, *eventFlushThreshold, *eventFlushInterval, shutdownEventsDropped, relay)
+
+	var unixgramSocket string
+	var listenerWG sync.WaitGroup
 
 	if *statsdListenUDP != "" {
 		udpListenAddr := udpAddrFromString(*statsdListenUDP)
@@ -190,6 +313,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer uconn.Close()
 
 		if *readBuffer != 0 {
 			err = uconn.SetReadBuffer(*readBuffer)
@@ -199,7 +323,11 @@ func main() {
 		}
 
 		ul := &StatsDUDPListener{conn: uconn, eventHandler: eventQueue}
-		go ul.Listen()
+		listenerWG.Add(1)
+		go func() {
+			defer listenerWG.Done()
+			ul.Listen(ctx)
+		}()
 	}
 
 	if *statsdListenTCP != "" {
@@ -211,7 +339,11 @@ func main() {
 		defer tconn.Close()
 
 		tl := &StatsDTCPListener{conn: tconn, eventHandler: eventQueue}
-		go tl.Listen()
+		listenerWG.Add(1)
+		go func() {
+			defer listenerWG.Done()
+			tl.Listen(ctx)
+		}()
 	}
 
 	if *statsdListenUnixgram != "" {
@@ -237,12 +369,16 @@ func main() {
 		}
 
 		ul := &StatsDUnixgramListener{conn: uxgconn, eventHandler: eventQueue}
-		go ul.Listen()
+		listenerWG.Add(1)
+		go func() {
+			defer listenerWG.Done()
+			ul.Listen(ctx)
+		}()
 
 		// if it's an abstract unix domain socket, it won't exist on fs
 		// so we can't chmod it either
 		if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			defer os.Remove(*statsdListenUnixgram)
+			unixgramSocket = *statsdListenUnixgram
 
 			// convert the string to octet
 			perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
@@ -258,10 +394,8 @@ func main() {
 
 	}
 
-	mapper := &mapper.MetricMapper{MappingsCount: mappingsCount}
 	if *mappingConfig != "" {
-		err := mapper.InitFromFile(*mappingConfig, *cacheSize)
-		if err != nil {
+		if err := reload.reload(); err != nil {
 			log.Fatal("Error loading config:", err)
 		}
 		if *dumpFSMPath != "" {
@@ -274,14 +408,52 @@ func main() {
 		mapper.InitCache(*cacheSize)
 	}
 
-	go configReloader(*mappingConfig, mapper, *cacheSize)
+	go reload.listenForSignals()
 
 	exporter := NewExporter(mapper)
 
+	// All listeners are bound and the initial mapping load (if any) has
+	// succeeded: the exporter can now report ready.
+	ready.set()
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	go exporter.Listen(events)
+	// exporter.Listen only takes events, not ctx: it must range over events
+	// to completion so that whatever the listeners flushed before exiting is
+	// still drained, rather than stopping as soon as shutdown begins.
+	exporterDone := make(chan struct{})
+	go func() {
+		exporter.Listen(events)
+		close(exporterDone)
+	}()
 
 	<-signals
+	log.Infoln("Received stop signal, shutting down")
+
+	// Stop accepting new packets and wait for the listener goroutines to
+	// actually exit before touching the event queue, so nothing can still be
+	// sending into it when we flush and close it below.
+	cancel()
+	listenerWG.Wait()
+	eventQueue.Flush()
+	close(events)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	defer shutdownCancel()
+
+	select {
+	case <-exporterDone:
+	case <-shutdownCtx.Done():
+		log.Warnln("Timed out waiting for the event queue to drain")
+	}
+
+	if unixgramSocket != "" {
+		if err := os.Remove(unixgramSocket); err != nil {
+			log.Warnf("Failed to remove unixgram socket %q: %v", unixgramSocket, err)
+		}
+	}
+
+	<-httpDone
+	log.Infoln("Shutdown complete")
 }
@@ -0,0 +1,215 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const defaultRelayPacketSize = 1432
+
+var (
+	relayLinesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "statsd_exporter_relay_lines_total",
+		Help: "Total number of statsd lines forwarded to relay destinations.",
+	}, []string{"destination", "outcome"})
+
+	relayBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "statsd_exporter_relay_bytes_total",
+		Help: "Total number of bytes forwarded to relay destinations.",
+	}, []string{"destination"})
+)
+
+func init() {
+	prometheus.MustRegister(relayLinesTotal, relayBytesTotal)
+}
+
+// relayDestination forwards raw statsd lines to a single downstream
+// statsd/Graphite server, batching them into MTU-sized packets.
+type relayDestination struct {
+	addr       string
+	network    string // "udp" or "tcp"
+	packetSize int
+	lines      chan string
+}
+
+// Relay sits in the event-handling path alongside eventQueue: every raw
+// statsd line handed to it is both translated for Prometheus and forwarded
+// verbatim to each configured destination, so the exporter can be dropped in
+// as a sidecar that keeps feeding a legacy statsd/Graphite pipeline.
+type Relay struct {
+	destinations []*relayDestination
+}
+
+// NewRelay parses addresses of the form "udp://host:port" or
+// "tcp://host:port" and starts a forwarding goroutine per destination.
+// packetSize bounds how many bytes of batched lines are sent in one
+// UDP packet or TCP write; a single line longer than packetSize is sent on
+// its own in a larger write.
+func NewRelay(ctx context.Context, addresses []string, packetSize int) (*Relay, error) {
+	if packetSize <= 0 {
+		packetSize = defaultRelayPacketSize
+	}
+
+	r := &Relay{}
+	for _, addr := range addresses {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		network, hostPort, err := splitRelayAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		d := &relayDestination{
+			addr:       hostPort,
+			network:    network,
+			packetSize: packetSize,
+			lines:      make(chan string, 1000),
+		}
+		r.destinations = append(r.destinations, d)
+		go d.run(ctx)
+	}
+	return r, nil
+}
+
+func splitRelayAddress(addr string) (network, hostPort string, err error) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("relay address %q must be of the form udp://host:port or tcp://host:port", addr)
+	}
+	network, hostPort = parts[0], parts[1]
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("relay address %q has unsupported network %q, want udp or tcp", addr, network)
+	}
+	return network, hostPort, nil
+}
+
+// Relay queues line for forwarding to every configured destination. It never
+// blocks on the network; a destination that is backed up drops the line and
+// counts it as "dropped" rather than slow down statsd ingestion.
+func (r *Relay) Relay(line string) {
+	for _, d := range r.destinations {
+		select {
+		case d.lines <- line:
+		default:
+			relayLinesTotal.WithLabelValues(d.addr, "dropped").Inc()
+		}
+	}
+}
+
+// run batches lines arriving on d.lines into packets no larger than
+// d.packetSize (a single line longer than that is sent on its own) and writes
+// them to the destination, reconnecting with exponential backoff on failure
+// until ctx is cancelled.
+func (d *relayDestination) run(ctx context.Context) {
+	var conn net.Conn
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 30 * time.Second
+
+	connect := func() bool {
+		var err error
+		conn, err = net.Dial(d.network, d.addr)
+		if err != nil {
+			log.Warnf("Relay: failed to connect to %s: %s", d.addr, err)
+			return false
+		}
+		backoff = 100 * time.Millisecond
+		return true
+	}
+
+	var batch strings.Builder
+	batchLines := 0
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		lines := batchLines
+		defer func() {
+			batch.Reset()
+			batchLines = 0
+		}()
+
+		// Reconnecting is only attempted from the ticker branch below, on its
+		// own backoff schedule, so a sustained outage doesn't turn every
+		// batch boundary on the line path into a fresh net.Dial attempt.
+		if conn == nil {
+			relayLinesTotal.WithLabelValues(d.addr, "dropped").Add(float64(lines))
+			return
+		}
+
+		if _, err := conn.Write([]byte(batch.String())); err != nil {
+			log.Warnf("Relay: write to %s failed: %s", d.addr, err)
+			conn.Close()
+			conn = nil
+			relayLinesTotal.WithLabelValues(d.addr, "dropped").Add(float64(lines))
+			return
+		}
+
+		relayLinesTotal.WithLabelValues(d.addr, "sent").Add(float64(lines))
+		relayBytesTotal.WithLabelValues(d.addr).Add(float64(batch.Len()))
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		case line, ok := <-d.lines:
+			if !ok {
+				flush()
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			if batch.Len()+len(line)+1 > d.packetSize {
+				flush()
+			}
+			batch.WriteString(line)
+			batch.WriteString("\n")
+			batchLines++
+		case <-ticker.C:
+			if conn == nil {
+				if !connect() {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(backoff):
+					}
+					backoff *= 2
+					if backoff > maxBackoff {
+						backoff = maxBackoff
+					}
+					continue
+				}
+			}
+			flush()
+		}
+	}
+}
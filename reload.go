@@ -0,0 +1,176 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// reloader owns the mutable, reloadable exporter state (the mapping config
+// and the web config) and serializes reloads so the SIGHUP handler and the
+// /-/reload HTTP handler can't race each other.
+type reloader struct {
+	fileName  string
+	mapper    *mapper.MetricMapper
+	cacheSize int
+	webCfg    *webConfigFile
+
+	mu sync.Mutex
+
+	reloadsTotal  uint64
+	reloadsFailed uint64
+}
+
+func newReloader(fileName string, m *mapper.MetricMapper, cacheSize int, webCfg *webConfigFile) *reloader {
+	return &reloader{fileName: fileName, mapper: m, cacheSize: cacheSize, webCfg: webCfg}
+}
+
+// reload re-reads the mapping config (if one was given) and the web config
+// file. It is safe to call concurrently from the signal handler and from the
+// HTTP handler.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	atomic.AddUint64(&r.reloadsTotal, 1)
+
+	if r.webCfg != nil {
+		if err := r.webCfg.reload(); err != nil {
+			atomic.AddUint64(&r.reloadsFailed, 1)
+			return err
+		}
+	}
+
+	if r.fileName == "" {
+		return nil
+	}
+	if err := r.mapper.InitFromFile(r.fileName, r.cacheSize); err != nil {
+		atomic.AddUint64(&r.reloadsFailed, 1)
+		configLoads.WithLabelValues("failure").Inc()
+		return err
+	}
+	configLoads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// listenForSignals reloads on every SIGHUP for the life of the process.
+func (r *reloader) listenForSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for s := range signals {
+		log.Infof("Received %s, attempting reload", s)
+		if err := r.reload(); err != nil {
+			log.Errorln("Error reloading config:", err)
+		} else {
+			log.Infoln("Config reloaded successfully")
+		}
+	}
+}
+
+// ServeHTTP implements POST /-/reload: trigger the same reload the SIGHUP
+// handler runs, returning the error (if any) as the response body.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// debugMappings returns the currently loaded mapping rules, the mapper's
+// cache statistics, and basic reload statistics, as JSON.
+func (r *reloader) debugMappings(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mapping_config_file": r.fileName,
+		"mappings":            r.mapper.Mappings,
+		"cache":               cacheStats(r.cacheSize),
+		"reloads_total":       atomic.LoadUint64(&r.reloadsTotal),
+		"reloads_failed":      atomic.LoadUint64(&r.reloadsFailed),
+	})
+}
+
+// cacheStats reports the mapper's cache size plus whatever hit/miss counters
+// the cache has registered with the default Prometheus registry, by scraping
+// the already-registered "statsd_exporter_cache_*" metric families. The
+// mapper's cache is unexported, so this is the only way to read it back from
+// outside the mapper package.
+func cacheStats(size int) map[string]float64 {
+	stats := map[string]float64{"size": float64(size)}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return stats
+	}
+	for _, mf := range families {
+		name := mf.GetName()
+		if !strings.HasPrefix(name, "statsd_exporter_cache_") {
+			continue
+		}
+		var total float64
+		for _, m := range mf.GetMetric() {
+			if c := m.GetCounter(); c != nil {
+				total += c.GetValue()
+			}
+			if g := m.GetGauge(); g != nil {
+				total += g.GetValue()
+			}
+		}
+		stats[strings.TrimPrefix(name, "statsd_exporter_cache_")] = total
+	}
+	return stats
+}
+
+// readiness tracks whether the exporter has completed its initial mapping
+// load and has all configured listeners bound, for use by /-/healthy and
+// /-/ready.
+type readiness struct {
+	ready int32
+}
+
+func (r *readiness) set()          { atomic.StoreInt32(&r.ready, 1) }
+func (r *readiness) isReady() bool { return atomic.LoadInt32(&r.ready) == 1 }
+
+func (r *readiness) healthyHandler(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *readiness) readyHandler(w http.ResponseWriter, req *http.Request) {
+	if !r.isReady() {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func certPoolFromFile(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// tlsServerConfig mirrors the upstream Prometheus exporter web-config
+// `tls_server_config` section.
+type tlsServerConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientCAFile   string   `yaml:"client_ca_file"`
+	ClientAuthType string   `yaml:"client_auth_type"`
+	MinVersion     string   `yaml:"min_version"`
+	MaxVersion     string   `yaml:"max_version"`
+	CipherSuites   []string `yaml:"cipher_suites"`
+}
+
+// webConfig is the top-level shape of --web.config.file.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var cipherSuites = func() map[string]uint16 {
+	m := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		m[c.Name] = c.ID
+	}
+	return m
+}()
+
+// loadWebConfig reads and parses the file at path. An empty path is valid and
+// yields a zero-value config, meaning: plaintext HTTP, no basic auth.
+func loadWebConfig(path string) (*webConfig, error) {
+	if path == "" {
+		return &webConfig{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading web config file: %s", err)
+	}
+	cfg := &webConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing web config file: %s", err)
+	}
+	return cfg, nil
+}
+
+// tlsConfig builds a *tls.Config from the parsed tls_server_config section.
+// It returns nil, nil when TLS is not configured, which callers should treat
+// as "serve plaintext HTTP".
+func (c *webConfig) tlsConfig() (*tls.Config, error) {
+	sc := c.TLSServerConfig
+	if sc == nil {
+		return nil, nil
+	}
+	if sc.CertFile == "" || sc.KeyFile == "" {
+		return nil, fmt.Errorf("tls_server_config requires both cert_file and key_file")
+	}
+
+	cert, err := tls.LoadX509KeyPair(sc.CertFile, sc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS key pair: %s", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if sc.MinVersion != "" {
+		v, ok := tlsVersions[sc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS min_version %q", sc.MinVersion)
+		}
+		tlsCfg.MinVersion = v
+	}
+	if sc.MaxVersion != "" {
+		v, ok := tlsVersions[sc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS max_version %q", sc.MaxVersion)
+		}
+		tlsCfg.MaxVersion = v
+	}
+
+	for _, name := range sc.CipherSuites {
+		id, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
+	}
+
+	if sc.ClientCAFile != "" {
+		pool, err := certPoolFromFile(sc.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client_ca_file: %s", err)
+		}
+		tlsCfg.ClientCAs = pool
+
+		authType, ok := clientAuthTypes[sc.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", sc.ClientAuthType)
+		}
+		tlsCfg.ClientAuth = authType
+	}
+
+	return tlsCfg, nil
+}
+
+// basicAuthMiddleware wraps next with HTTP basic-auth, checked against
+// bcrypt-hashed passwords from basic_auth_users. If no users are configured
+// it is a no-op.
+func (c *webConfig) basicAuthMiddleware(next http.Handler) http.Handler {
+	if len(c.BasicAuthUsers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		hash, exists := c.BasicAuthUsers[user]
+		if !ok || !exists || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="statsd_exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}